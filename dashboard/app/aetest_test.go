@@ -0,0 +1,21 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+// newTestContext returns a context backed by a fresh in-memory datastore,
+// and a function the caller must defer to tear it down.
+func newTestContext(t *testing.T) (context.Context, func()) {
+	c, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatalf("failed to create aetest context: %v", err)
+	}
+	return c, done
+}
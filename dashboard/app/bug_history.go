@@ -0,0 +1,56 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const bugHistoryPageSize = 100
+
+// apiBugHistory serves dashapi.BugHistoryReq: a paginated, newest-first
+// view of the BugHistory entries recorded for a bug.
+func apiBugHistory(c context.Context, r *dashapi.BugHistoryReq) (*dashapi.BugHistoryResp, error) {
+	q := datastore.NewQuery("BugHistory").
+		Filter("BugHash=", r.BugHash).
+		Order("-Time").
+		Limit(bugHistoryPageSize)
+	if r.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(r.Cursor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode cursor: %v", err)
+		}
+		q = q.Start(cursor)
+	}
+	resp := new(dashapi.BugHistoryResp)
+	it := q.Run(c)
+	for {
+		hist := new(BugHistory)
+		_, err := it.Next(hist)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to query bug history for %v: %v", r.BugHash, err)
+		}
+		resp.Entries = append(resp.Entries, dashapi.BugHistoryEntry{
+			Time:     hist.Time,
+			Actor:    hist.Actor,
+			Action:   hist.Action,
+			OldValue: hist.OldValue,
+			NewValue: hist.NewValue,
+			Reason:   hist.Reason,
+		})
+	}
+	if len(resp.Entries) == bugHistoryPageSize {
+		if cursor, err := it.Cursor(); err == nil {
+			resp.Cursor = cursor.String()
+		}
+	}
+	return resp, nil
+}
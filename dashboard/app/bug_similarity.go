@@ -0,0 +1,268 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	// The signature is split into signatureBands LSH bands of
+	// signatureBandRows hashes each: two bugs sharing any one band's hash
+	// are queried as dup candidates, and their full signatures are then
+	// compared with estimateJaccard.
+	signatureBands    = 20
+	signatureBandRows = 4
+	signatureSize     = signatureBands * signatureBandRows
+
+	defaultSimilarityThreshold = 0.7
+)
+
+var stackFrameRe = regexp.MustCompile(`(?m)^\s*([a-zA-Z_][a-zA-Z0-9_.]*)\+0x[0-9a-f]+/0x[0-9a-f]+`)
+
+// normalizeReport extracts stack frame function names from a crash report,
+// lowercased and stripped of addresses/offsets, so that reports differing
+// only in addresses or register dumps produce the same tokens.
+func normalizeReport(report []byte) []string {
+	var tokens []string
+	for _, m := range stackFrameRe.FindAllStringSubmatch(string(report), -1) {
+		tokens = append(tokens, strings.ToLower(m[1]))
+	}
+	return tokens
+}
+
+// computeSignature builds a MinHash signature over 3-token shingles of the
+// normalized stack frames of a crash report; the shingles starting at the
+// last two frames hold fewer tokens. Returns nil if the report has
+// no recognizable stack frames (e.g. it's empty).
+func computeSignature(report []byte) []uint64 {
+	tokens := normalizeReport(report)
+	if len(tokens) == 0 {
+		return nil
+	}
+	const shingleLen = 3
+	shingles := make(map[string]bool)
+	for i := range tokens {
+		end := i + shingleLen
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		shingles[strings.Join(tokens[i:end], "|")] = true
+	}
+	sig := make([]uint64, signatureSize)
+	for i := range sig {
+		sig[i] = math.MaxUint64
+	}
+	for shingle := range shingles {
+		for i := range sig {
+			if h := hashShingle(shingle, i); h < sig[i] {
+				sig[i] = h
+			}
+		}
+	}
+	return sig
+}
+
+func hashShingle(shingle string, seed int) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(shingle))
+	var seedBuf [8]byte
+	binary.LittleEndian.PutUint64(seedBuf[:], uint64(seed))
+	h.Write(seedBuf[:])
+	return h.Sum64()
+}
+
+// estimateJaccard estimates the Jaccard similarity of the two shingle sets
+// that a and b are MinHash signatures of, as the fraction of positions at
+// which they agree.
+func estimateJaccard(a, b []uint64) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	equal := 0
+	for i := range a {
+		if a[i] == b[i] {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(a))
+}
+
+// lshBandHashes splits sig into signatureBands bands of signatureBandRows
+// hashes each and returns one combined hash per band, for LSH indexing.
+func lshBandHashes(sig []uint64) []string {
+	if len(sig) != signatureSize {
+		return nil
+	}
+	bands := make([]string, signatureBands)
+	for b := range bands {
+		h := fnv.New64a()
+		var buf [8]byte
+		for r := 0; r < signatureBandRows; r++ {
+			binary.LittleEndian.PutUint64(buf[:], sig[b*signatureBandRows+r])
+			h.Write(buf[:])
+		}
+		bands[b] = strconv.FormatUint(h.Sum64(), 16)
+	}
+	return bands
+}
+
+func bugSignatureBandKey(c context.Context, ns string, band int, bandHash, bugHash string) *datastore.Key {
+	h := fmt.Sprintf("%v-%v-%v-%v", ns, band, bandHash, bugHash)
+	return datastore.NewKey(c, "BugSignatureBand", h, 0, nil)
+}
+
+// indexBugSignature stores one BugSignatureBand per LSH band of sig, so
+// that findSimilarBugs can later look bugHash up as a candidate.
+func indexBugSignature(c context.Context, ns, bugHash string, sig []uint64) error {
+	bands := lshBandHashes(sig)
+	keys := make([]*datastore.Key, len(bands))
+	vals := make([]*BugSignatureBand, len(bands))
+	for i, bandHash := range bands {
+		keys[i] = bugSignatureBandKey(c, ns, i, bandHash, bugHash)
+		vals[i] = &BugSignatureBand{Namespace: ns, Band: i, Hash: bandHash, BugHash: bugHash}
+	}
+	if _, err := datastore.PutMulti(c, keys, vals); err != nil {
+		return fmt.Errorf("failed to index bug signature for %v: %v", bugHash, err)
+	}
+	return nil
+}
+
+// findSimilarBugs queries the LSH bands of sig for candidate bugs in ns,
+// and returns the hash of the most similar one whose estimated Jaccard
+// similarity is at least threshold, or "" if none qualifies.
+func findSimilarBugs(c context.Context, ns, bugHash string, sig []uint64, threshold float64) (string, error) {
+	candidates := make(map[string]bool)
+	for i, bandHash := range lshBandHashes(sig) {
+		var matches []*BugSignatureBand
+		_, err := datastore.NewQuery("BugSignatureBand").
+			Filter("Namespace=", ns).
+			Filter("Band=", i).
+			Filter("Hash=", bandHash).
+			GetAll(c, &matches)
+		if err != nil {
+			return "", fmt.Errorf("failed to query signature band %v for %v: %v", i, bugHash, err)
+		}
+		for _, m := range matches {
+			if m.BugHash != bugHash {
+				candidates[m.BugHash] = true
+			}
+		}
+	}
+	candList := make([]string, 0, len(candidates))
+	for candHash := range candidates {
+		candList = append(candList, candHash)
+	}
+	sort.Strings(candList) // deterministic tie-break: map iteration order is randomized
+	best, bestSim := "", -1.0
+	for _, candHash := range candList {
+		cand := new(Bug)
+		if err := datastore.Get(c, datastore.NewKey(c, "Bug", candHash, 0, nil), cand); err != nil {
+			continue
+		}
+		if sim := estimateJaccard(sig, cand.Signature); sim >= threshold && sim > bestSim {
+			best, bestSim = candHash, sim
+		}
+	}
+	return best, nil
+}
+
+// namespaceSimilarityThreshold returns the Jaccard threshold above which a
+// candidate bug is suggested as a dup in ns, preferring an admin override
+// saved via the similarity-tuning endpoint over defaultSimilarityThreshold.
+func namespaceSimilarityThreshold(c context.Context, ns string) float64 {
+	cfg := new(NamespaceSimilarityConfig)
+	key := datastore.NewKey(c, "NamespaceSimilarityConfig", ns, 0, nil)
+	if err := datastore.Get(c, key, cfg); err == nil && cfg.Threshold > 0 {
+		return cfg.Threshold
+	}
+	return defaultSimilarityThreshold
+}
+
+// onBugCreated computes a similarity signature for a newly created bug from
+// its crash report, indexes it for LSH lookup, and, if a sufficiently
+// similar existing bug is found, sets bug.SuggestedDupOf for a human to
+// confirm via the dashboard UI. bug.Namespace must already be set; the
+// caller is responsible for persisting bug afterwards.
+func onBugCreated(c context.Context, bug *Bug, bugHash string, report []byte) error {
+	sig := computeSignature(report)
+	if sig == nil {
+		return nil
+	}
+	bug.Signature = sig
+	if err := indexBugSignature(c, bug.Namespace, bugHash, sig); err != nil {
+		return err
+	}
+	suggested, err := findSimilarBugs(c, bug.Namespace, bugHash, sig, namespaceSimilarityThreshold(c, bug.Namespace))
+	if err != nil {
+		return fmt.Errorf("failed to search for similar bugs to %v: %v", bugHash, err)
+	}
+	if suggested != "" && suggested != bug.SuggestedDupOf {
+		err := addBugHistory(c, bug.Namespace, bugHash, "similarity-engine", bugHistorySuggestedDup,
+			bug.SuggestedDupOf, suggested, "LSH/MinHash report similarity above threshold")
+		if err != nil {
+			return err
+		}
+	}
+	bug.SuggestedDupOf = suggested
+	return nil
+}
+
+// backfillBugSignatures computes and indexes signatures for bugs in ns that
+// were created before this subsystem existed. One-off, admin-triggered.
+func backfillBugSignatures(c context.Context, ns string) error {
+	var bugs []*Bug
+	keys, err := datastore.NewQuery("Bug").Filter("Namespace=", ns).GetAll(c, &bugs)
+	if err != nil {
+		return fmt.Errorf("failed to query bugs in %v: %v", ns, err)
+	}
+	for i, bug := range bugs {
+		if len(bug.Signature) != 0 || !bug.HasReport {
+			continue
+		}
+		bugHash := keys[i].StringID()
+		report, err := latestCrashReportText(c, ns, keys[i])
+		if err != nil {
+			return fmt.Errorf("failed to load report for %v: %v", bugHash, err)
+		}
+		if report == nil {
+			continue
+		}
+		if err := onBugCreated(c, bug, bugHash, report); err != nil {
+			return err
+		}
+		if _, err := datastore.Put(c, keys[i], bug); err != nil {
+			return fmt.Errorf("failed to save bug %v: %v", bugHash, err)
+		}
+	}
+	return nil
+}
+
+// latestCrashReportText returns the decompressed Report text of the most
+// recent Crash under bugKey, or nil if it has no crashes or no report yet.
+func latestCrashReportText(c context.Context, ns string, bugKey *datastore.Key) ([]byte, error) {
+	var crashes []*Crash
+	_, err := datastore.NewQuery("Crash").Ancestor(bugKey).Order("-Time").Limit(1).GetAll(c, &crashes)
+	if err != nil {
+		return nil, err
+	}
+	if len(crashes) == 0 || crashes[0].Report == "" {
+		return nil, nil
+	}
+	text := new(Text)
+	if err := datastore.Get(c, textKey(c, ns, crashes[0].Report), text); err != nil {
+		return nil, err
+	}
+	return gunzipData(text.Text)
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// apiSimilarityConfig serves dashapi.SimilarityConfigReq, letting an admin
+// tune the dup-suggestion threshold for a namespace without a redeploy.
+func apiSimilarityConfig(c context.Context, r *dashapi.SimilarityConfigReq) (*dashapi.SimilarityConfigResp, error) {
+	if r.Threshold <= 0 || r.Threshold > 1 {
+		return nil, fmt.Errorf("threshold must be in (0, 1], got %v", r.Threshold)
+	}
+	cfg := &NamespaceSimilarityConfig{Namespace: r.Namespace, Threshold: r.Threshold}
+	key := datastore.NewKey(c, "NamespaceSimilarityConfig", r.Namespace, 0, nil)
+	if _, err := datastore.Put(c, key, cfg); err != nil {
+		return nil, fmt.Errorf("failed to save similarity config for %v: %v", r.Namespace, err)
+	}
+	return &dashapi.SimilarityConfigResp{}, nil
+}
+
+// apiRecluster serves dashapi.ReclusterReq: it re-evaluates SuggestedDupOf
+// for every already-signatured bug in the namespace against its current
+// similarity threshold, e.g. after the threshold was tuned.
+func apiRecluster(c context.Context, r *dashapi.ReclusterReq) (*dashapi.ReclusterResp, error) {
+	threshold := namespaceSimilarityThreshold(c, r.Namespace)
+	var bugs []*Bug
+	keys, err := datastore.NewQuery("Bug").Filter("Namespace=", r.Namespace).GetAll(c, &bugs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query bugs in %v: %v", r.Namespace, err)
+	}
+	resp := new(dashapi.ReclusterResp)
+	for i, bug := range bugs {
+		if len(bug.Signature) == 0 {
+			continue
+		}
+		bugHash := keys[i].StringID()
+		suggested, err := findSimilarBugs(c, r.Namespace, bugHash, bug.Signature, threshold)
+		if err != nil {
+			return nil, err
+		}
+		if suggested == bug.SuggestedDupOf {
+			continue
+		}
+		err = addBugHistory(c, r.Namespace, bugHash, "admin-recluster", bugHistorySuggestedDup,
+			bug.SuggestedDupOf, suggested, "namespace recluster")
+		if err != nil {
+			return nil, err
+		}
+		bug.SuggestedDupOf = suggested
+		if _, err := datastore.Put(c, keys[i], bug); err != nil {
+			return nil, fmt.Errorf("failed to save bug %v: %v", bugHash, err)
+		}
+		resp.Updated++
+	}
+	return resp, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestComputeSignatureDeterministic(t *testing.T) {
+	report := []byte(`
+BUG: kernel panic
+ foo_bar+0x123/0x456
+ baz_qux+0x1/0x2
+`)
+	sig1 := computeSignature(report)
+	sig2 := computeSignature(report)
+	if len(sig1) != signatureSize {
+		t.Fatalf("want signature of length %v, got %v", signatureSize, len(sig1))
+	}
+	for i := range sig1 {
+		if sig1[i] != sig2[i] {
+			t.Fatalf("signature not deterministic at position %v: %v != %v", i, sig1[i], sig2[i])
+		}
+	}
+}
+
+func TestComputeSignatureEmptyReport(t *testing.T) {
+	if sig := computeSignature([]byte("no stack frames here")); sig != nil {
+		t.Fatalf("want nil signature for a report with no recognizable stack frames, got %v", sig)
+	}
+}
+
+func TestEstimateJaccard(t *testing.T) {
+	a := computeSignature([]byte(" foo_bar+0x123/0x456\n baz_qux+0x1/0x2\n"))
+	b := computeSignature([]byte(" foo_bar+0x123/0x456\n baz_qux+0x1/0x2\n"))
+	if sim := estimateJaccard(a, b); sim != 1 {
+		t.Fatalf("want identical signatures to have similarity 1, got %v", sim)
+	}
+
+	c := computeSignature([]byte(" totally_unrelated_func+0x1/0x2\n another_func+0x1/0x2\n"))
+	if sim := estimateJaccard(a, c); sim >= 0.5 {
+		t.Fatalf("want disjoint signatures to have low similarity, got %v", sim)
+	}
+
+	if sim := estimateJaccard(nil, nil); sim != 0 {
+		t.Fatalf("want similarity 0 for empty signatures, got %v", sim)
+	}
+	if sim := estimateJaccard([]uint64{1, 2}, []uint64{1, 2, 3}); sim != 0 {
+		t.Fatalf("want similarity 0 for mismatched-length signatures, got %v", sim)
+	}
+}
+
+func TestLshBandHashesDeterministic(t *testing.T) {
+	sig := computeSignature([]byte(" foo_bar+0x123/0x456\n baz_qux+0x1/0x2\n"))
+	bands1 := lshBandHashes(sig)
+	bands2 := lshBandHashes(sig)
+	if len(bands1) != signatureBands {
+		t.Fatalf("want %v bands, got %v", signatureBands, len(bands1))
+	}
+	for i := range bands1 {
+		if bands1[i] != bands2[i] {
+			t.Fatalf("band %v not deterministic: %v != %v", i, bands1[i], bands2[i])
+		}
+	}
+}
+
+func TestLshBandHashesWrongSize(t *testing.T) {
+	if bands := lshBandHashes([]uint64{1, 2, 3}); bands != nil {
+		t.Fatalf("want nil bands for a signature of the wrong size, got %v", bands)
+	}
+}
+
+func TestOnBugCreatedSuggestsSimilarBug(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	const ns = "test-ns"
+	report := []byte(`
+BUG: kernel panic in foo
+ foo_bar+0x123/0x456
+ baz_qux+0x1/0x2
+ quux_frob+0x1/0x2
+`)
+
+	existing := &Bug{Namespace: ns, Title: "existing bug"}
+	if err := onBugCreated(c, existing, "existing-hash", report); err != nil {
+		t.Fatalf("onBugCreated for existing bug failed: %v", err)
+	}
+	if existing.Signature == nil {
+		t.Fatalf("existing bug should have a signature")
+	}
+	if _, err := datastore.Put(c, datastore.NewKey(c, "Bug", "existing-hash", 0, nil), existing); err != nil {
+		t.Fatalf("failed to save existing bug: %v", err)
+	}
+
+	newBug := &Bug{Namespace: ns, Title: "duplicate bug"}
+	if err := onBugCreated(c, newBug, "new-hash", report); err != nil {
+		t.Fatalf("onBugCreated for new bug failed: %v", err)
+	}
+	if newBug.SuggestedDupOf != "existing-hash" {
+		t.Fatalf("want SuggestedDupOf=existing-hash for an identical report, got %q", newBug.SuggestedDupOf)
+	}
+
+	var hist []*BugHistory
+	if _, err := datastore.NewQuery("BugHistory").Filter("BugHash=", "new-hash").GetAll(c, &hist); err != nil {
+		t.Fatalf("failed to query bug history: %v", err)
+	}
+	if len(hist) != 1 || hist[0].NewValue != "existing-hash" {
+		t.Fatalf("want one bug history entry recording the suggestion, got %+v", hist)
+	}
+}
+
+func TestOnBugCreatedNoSuggestionForUnrelatedBug(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	const ns = "test-ns"
+	existing := &Bug{Namespace: ns, Title: "existing bug"}
+	existingReport := []byte(" foo_bar+0x123/0x456\n baz_qux+0x1/0x2\n quux_frob+0x1/0x2\n")
+	if err := onBugCreated(c, existing, "existing-hash", existingReport); err != nil {
+		t.Fatalf("onBugCreated for existing bug failed: %v", err)
+	}
+	if _, err := datastore.Put(c, datastore.NewKey(c, "Bug", "existing-hash", 0, nil), existing); err != nil {
+		t.Fatalf("failed to save existing bug: %v", err)
+	}
+
+	newBug := &Bug{Namespace: ns, Title: "unrelated bug"}
+	unrelatedReport := []byte(" totally_different_a+0x1/0x2\n totally_different_b+0x1/0x2\n totally_different_c+0x1/0x2\n")
+	if err := onBugCreated(c, newBug, "new-hash", unrelatedReport); err != nil {
+		t.Fatalf("onBugCreated for new bug failed: %v", err)
+	}
+	if newBug.SuggestedDupOf != "" {
+		t.Fatalf("want no suggestion for an unrelated report, got %q", newBug.SuggestedDupOf)
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+// Config holds the static dashboard configuration, keyed by namespace.
+type Config struct {
+	Namespaces map[string]*Namespace
+}
+
+// Namespace holds the static, per-namespace dashboard configuration.
+type Namespace struct {
+	// Key namespaces bug hashes (see bugKeyHash) so that
+	// entities can't collide across namespaces that pick the same title.
+	Key string
+
+	// CrashRetention overrides defaultCrashRetentionPolicy for this
+	// namespace; the zero value means "use the default".
+	CrashRetention CrashRetentionPolicy
+}
+
+var config *Config
@@ -0,0 +1,164 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// CrashRetentionPolicy replaces the old global maxCrashes hard cap, which
+// silently dropped crashes for a bug once reached and lost signal for rare
+// kernel configs. A namespace can combine:
+//   - KeepAllWithRepro: never prune a crash that has a reproducer;
+//   - ReservoirPerBucket: cap crashes within each (Manager, BuildID) bucket
+//     at N, so manager/build diversity is preserved instead of the newest
+//     crashes for one noisy bucket crowding out every other bucket. Since
+//     enforcement always sees the whole existing set rather than a live
+//     stream, this keeps the newest N per bucket rather than a true
+//     running reservoir sample;
+//   - SoftCap: once a bug holds more than this many crashes in total
+//     (after bucket sampling), prune the oldest ones first.
+type CrashRetentionPolicy struct {
+	KeepAllWithRepro   bool
+	ReservoirPerBucket int
+	SoftCap            int
+}
+
+// defaultCrashRetentionPolicy applies the old maxCrashes limit, per bucket
+// and in total, for namespaces that don't configure CrashRetentionPolicy.
+// Unlike the old hard cap, it keeps new crashes and prunes the oldest ones.
+var defaultCrashRetentionPolicy = CrashRetentionPolicy{
+	ReservoirPerBucket: maxCrashes,
+	SoftCap:            maxCrashes,
+}
+
+// namespaceCrashRetention returns the crash retention policy configured for
+// ns via config.Namespaces[ns].CrashRetention, falling back to
+// defaultCrashRetentionPolicy if the namespace is unconfigured or left its
+// CrashRetention at the zero value.
+func namespaceCrashRetention(ns string) CrashRetentionPolicy {
+	if nsConfig := config.Namespaces[ns]; nsConfig != nil && nsConfig.CrashRetention != (CrashRetentionPolicy{}) {
+		return nsConfig.CrashRetention
+	}
+	return defaultCrashRetentionPolicy
+}
+
+// saveCrash stores crash under bugKey and then enforces the namespace's
+// crash retention policy in a separate transaction, replacing the
+// unconditional maxCrashes check that used to live in the crash-insert path.
+// The two steps are not one transaction because a query inside a datastore
+// transaction does not see entities written earlier in that transaction.
+func saveCrash(c context.Context, ns string, bugKey *datastore.Key, crash *Crash) error {
+	policy := namespaceCrashRetention(ns)
+	if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Crash", bugKey), crash); err != nil {
+		return fmt.Errorf("failed to save crash for %v: %v", bugKey, err)
+	}
+	if policy.KeepAllWithRepro && (crash.ReproSyz != "" || crash.ReproC != "") {
+		return nil
+	}
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		return enforceCrashRetention(c, ns, bugKey, policy)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return fmt.Errorf("failed to save crash for %v: %v", bugKey, err)
+	}
+	return nil
+}
+
+// enforceCrashRetention prunes Crash entities under bugKey down to policy's
+// caps: first trimming each (Manager, BuildID) bucket to its newest
+// ReservoirPerBucket crashes, then, if the bug still holds more crashes than
+// SoftCap, deleting the oldest ones until it doesn't. Every pruned crash's
+// Log/Report/ReproSyz/ReproC text references are released, since Text is
+// refcounted (see putText/releaseText) and skipping this would leak the
+// blobs those crashes were the last referrer of. Must run inside a
+// cross-group (XG) transaction that includes bugKey's entity group, since
+// each released Text is its own entity group. As that transaction is
+// already open by the time we get here, text references are released via
+// releaseTextTx rather than releaseText, which would try to open a second,
+// nested transaction.
+func enforceCrashRetention(c context.Context, ns string, bugKey *datastore.Key, policy CrashRetentionPolicy) error {
+	var crashes []*Crash
+	keys, err := datastore.NewQuery("Crash").Ancestor(bugKey).Order("Time").GetAll(c, &crashes)
+	if err != nil {
+		return fmt.Errorf("failed to query crashes for retention: %v", err)
+	}
+	// eligible holds the keys that may be pruned, oldest first, excluding
+	// any crash that KeepAllWithRepro protects; both the bucket cap and
+	// the soft cap below only ever delete from this set.
+	var eligible []*datastore.Key
+	crashByKey := make(map[string]*Crash, len(keys))
+	buckets := make(map[string][]*datastore.Key)
+	for i, crash := range crashes {
+		crashByKey[keys[i].Encode()] = crash
+		if policy.KeepAllWithRepro && (crash.ReproSyz != "" || crash.ReproC != "") {
+			continue
+		}
+		eligible = append(eligible, keys[i])
+		bucket := crash.Manager + "|" + crash.BuildID
+		buckets[bucket] = append(buckets[bucket], keys[i])
+	}
+	toDelete := make(map[string]*datastore.Key)
+	for _, bucketKeys := range buckets {
+		if len(bucketKeys) <= policy.ReservoirPerBucket {
+			continue
+		}
+		// Keys are in ascending Time order within the bucket, so the
+		// overflow at the front is the oldest sampled-out portion.
+		for _, key := range bucketKeys[:len(bucketKeys)-policy.ReservoirPerBucket] {
+			toDelete[key.Encode()] = key
+		}
+	}
+	if remaining := len(eligible) - len(toDelete); policy.SoftCap > 0 && remaining > policy.SoftCap {
+		need := remaining - policy.SoftCap
+		for _, key := range eligible {
+			if need == 0 {
+				break
+			}
+			if _, ok := toDelete[key.Encode()]; ok {
+				continue
+			}
+			toDelete[key.Encode()] = key
+			need--
+		}
+	}
+	if len(toDelete) == 0 {
+		return nil
+	}
+	keysToDelete := make([]*datastore.Key, 0, len(toDelete))
+	for enc, key := range toDelete {
+		crash := crashByKey[enc]
+		for _, textKey := range []string{crash.Log, crash.Report, crash.ReproSyz, crash.ReproC} {
+			if err := releaseTextTx(c, ns, textKey); err != nil {
+				return fmt.Errorf("failed to release text for pruned crash %v: %v", key, err)
+			}
+		}
+		keysToDelete = append(keysToDelete, key)
+	}
+	return datastore.DeleteMulti(c, keysToDelete)
+}
+
+// cleanupCrashRetention walks every bug in ns and (re-)applies its current
+// crash retention policy. Intended to run periodically as a background
+// task so that crashes inserted before a policy existed or changed still
+// get pruned.
+func cleanupCrashRetention(c context.Context, ns string) error {
+	policy := namespaceCrashRetention(ns)
+	bugKeys, err := datastore.NewQuery("Bug").Filter("Namespace=", ns).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return fmt.Errorf("failed to query bugs in %v: %v", ns, err)
+	}
+	for _, bugKey := range bugKeys {
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			return enforceCrashRetention(c, ns, bugKey, policy)
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			return fmt.Errorf("failed to enforce crash retention for %v: %v", bugKey, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func mustPutCrash(t *testing.T, c context.Context, bugKey *datastore.Key, ns string, crash *Crash) *datastore.Key {
+	crashKey := datastore.NewIncompleteKey(c, "Crash", bugKey)
+	key, err := datastore.Put(c, crashKey, crash)
+	if err != nil {
+		t.Fatalf("failed to put crash: %v", err)
+	}
+	return key
+}
+
+func TestEnforceCrashRetentionSoftCap(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	const ns = "test-ns"
+	bugKey := datastore.NewKey(c, "Bug", "softcap-bug", 0, nil)
+	policy := CrashRetentionPolicy{ReservoirPerBucket: 100, SoftCap: 3}
+
+	var keys []*datastore.Key
+	for i := 0; i < 5; i++ {
+		logKey, err := putText(c, ns, []byte(fmt.Sprintf("log-%v", i)))
+		if err != nil {
+			t.Fatalf("putText failed: %v", err)
+		}
+		crash := &Crash{
+			Manager: "manager1",
+			BuildID: "build1",
+			Time:    time.Unix(int64(i), 0),
+			Log:     logKey,
+		}
+		keys = append(keys, mustPutCrash(t, c, bugKey, ns, crash))
+	}
+
+	if err := enforceCrashRetention(c, ns, bugKey, policy); err != nil {
+		t.Fatalf("enforceCrashRetention failed: %v", err)
+	}
+
+	var remaining []*Crash
+	remainingKeys, err := datastore.NewQuery("Crash").Ancestor(bugKey).GetAll(c, &remaining)
+	if err != nil {
+		t.Fatalf("failed to query remaining crashes: %v", err)
+	}
+	if len(remaining) != policy.SoftCap {
+		t.Fatalf("want %v crashes remaining, got %v", policy.SoftCap, len(remaining))
+	}
+	// The two oldest crashes (index 0 and 1) should be the ones pruned.
+	for _, key := range []*datastore.Key{keys[0], keys[1]} {
+		found := false
+		for _, rk := range remainingKeys {
+			if rk.Equal(key) {
+				found = true
+			}
+		}
+		if found {
+			t.Fatalf("oldest crash %v should have been pruned", key)
+		}
+	}
+
+	// The pruned crashes' Text references must have been released, not leaked.
+	for i := 0; i < 2; i++ {
+		key := textKey(c, ns, textHash([]byte(fmt.Sprintf("log-%v", i))))
+		if err := datastore.Get(c, key, new(Text)); err != datastore.ErrNoSuchEntity {
+			t.Fatalf("text for pruned crash %v should have been released, err=%v", i, err)
+		}
+	}
+}
+
+func TestEnforceCrashRetentionReservoirPerBucket(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	const ns = "test-ns"
+	bugKey := datastore.NewKey(c, "Bug", "bucket-bug", 0, nil)
+	policy := CrashRetentionPolicy{ReservoirPerBucket: 2, SoftCap: 100}
+
+	for _, manager := range []string{"manager1", "manager2"} {
+		for i := 0; i < 4; i++ {
+			crash := &Crash{
+				Manager: manager,
+				BuildID: "build1",
+				Time:    time.Unix(int64(i), 0),
+			}
+			mustPutCrash(t, c, bugKey, ns, crash)
+		}
+	}
+
+	if err := enforceCrashRetention(c, ns, bugKey, policy); err != nil {
+		t.Fatalf("enforceCrashRetention failed: %v", err)
+	}
+
+	var remaining []*Crash
+	if _, err := datastore.NewQuery("Crash").Ancestor(bugKey).GetAll(c, &remaining); err != nil {
+		t.Fatalf("failed to query remaining crashes: %v", err)
+	}
+	perManager := make(map[string]int)
+	for _, crash := range remaining {
+		perManager[crash.Manager]++
+	}
+	for _, manager := range []string{"manager1", "manager2"} {
+		if perManager[manager] != policy.ReservoirPerBucket {
+			t.Fatalf("manager %v: want %v crashes kept, got %v", manager, policy.ReservoirPerBucket, perManager[manager])
+		}
+	}
+}
+
+// TestSaveCrashEnforcesRetentionInTransaction exercises retention pruning
+// through saveCrash, the real entry point, rather than calling
+// enforceCrashRetention directly. enforceCrashRetention always runs inside a
+// transaction there, which is what makes it release text via releaseTextTx
+// instead of releaseText — calling enforceCrashRetention standalone (as the
+// tests above do) never opens that outer transaction, so it can't catch a
+// regression back to the nested-transaction bug.
+func TestSaveCrashEnforcesRetentionInTransaction(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	const ns = "test-ns"
+	bugKey := datastore.NewKey(c, "Bug", "save-crash-bug", 0, nil)
+	policy := CrashRetentionPolicy{ReservoirPerBucket: 100, SoftCap: 2}
+	config = &Config{Namespaces: map[string]*Namespace{
+		ns: {Key: ns, CrashRetention: policy},
+	}}
+
+	var releasedKeys []string
+	for i := 0; i < 3; i++ {
+		logKey, err := putText(c, ns, []byte(fmt.Sprintf("saved-log-%v", i)))
+		if err != nil {
+			t.Fatalf("putText failed: %v", err)
+		}
+		releasedKeys = append(releasedKeys, logKey)
+		crash := &Crash{
+			Manager: "manager1",
+			BuildID: "build1",
+			Time:    time.Unix(int64(i), 0),
+			Log:     logKey,
+		}
+		if err := saveCrash(c, ns, bugKey, crash); err != nil {
+			t.Fatalf("saveCrash failed: %v", err)
+		}
+	}
+
+	var remaining []*Crash
+	if _, err := datastore.NewQuery("Crash").Ancestor(bugKey).GetAll(c, &remaining); err != nil {
+		t.Fatalf("failed to query remaining crashes: %v", err)
+	}
+	if len(remaining) != policy.SoftCap {
+		t.Fatalf("want %v crashes remaining, got %v", policy.SoftCap, len(remaining))
+	}
+
+	// The oldest crash's text should have been released without saveCrash's
+	// transaction failing on a nested transaction.
+	key := textKey(c, ns, releasedKeys[0])
+	if err := datastore.Get(c, key, new(Text)); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("text for pruned crash should have been released, err=%v", err)
+	}
+}
+
+// TestCleanupCrashRetentionEnforcesInTransaction is cleanupCrashRetention's
+// counterpart to TestSaveCrashEnforcesRetentionInTransaction: it also wraps
+// enforceCrashRetention in its own transaction, via a separate call path.
+func TestCleanupCrashRetentionEnforcesInTransaction(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	const ns = "test-ns"
+	bug := &Bug{Namespace: ns}
+	bugKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Bug", nil), bug)
+	if err != nil {
+		t.Fatalf("failed to put bug: %v", err)
+	}
+	policy := CrashRetentionPolicy{ReservoirPerBucket: 100, SoftCap: 1}
+	config = &Config{Namespaces: map[string]*Namespace{
+		ns: {Key: ns, CrashRetention: policy},
+	}}
+
+	for i := 0; i < 3; i++ {
+		logKey, err := putText(c, ns, []byte(fmt.Sprintf("cleanup-log-%v", i)))
+		if err != nil {
+			t.Fatalf("putText failed: %v", err)
+		}
+		mustPutCrash(t, c, bugKey, ns, &Crash{
+			Manager: "manager1",
+			BuildID: "build1",
+			Time:    time.Unix(int64(i), 0),
+			Log:     logKey,
+		})
+	}
+
+	if err := cleanupCrashRetention(c, ns); err != nil {
+		t.Fatalf("cleanupCrashRetention failed: %v", err)
+	}
+
+	var remaining []*Crash
+	if _, err := datastore.NewQuery("Crash").Ancestor(bugKey).GetAll(c, &remaining); err != nil {
+		t.Fatalf("failed to query remaining crashes: %v", err)
+	}
+	if len(remaining) != policy.SoftCap {
+		t.Fatalf("want %v crashes remaining, got %v", policy.SoftCap, len(remaining))
+	}
+}
+
+func TestEnforceCrashRetentionKeepAllWithRepro(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	const ns = "test-ns"
+	bugKey := datastore.NewKey(c, "Bug", "repro-bug", 0, nil)
+	policy := CrashRetentionPolicy{KeepAllWithRepro: true, ReservoirPerBucket: 1, SoftCap: 1}
+
+	reproKey := mustPutCrash(t, c, bugKey, ns, &Crash{
+		Manager: "manager1", BuildID: "build1", Time: time.Unix(0, 0), ReproSyz: "some-key",
+	})
+	for i := 1; i < 4; i++ {
+		mustPutCrash(t, c, bugKey, ns, &Crash{
+			Manager: "manager1", BuildID: "build1", Time: time.Unix(int64(i), 0),
+		})
+	}
+
+	if err := enforceCrashRetention(c, ns, bugKey, policy); err != nil {
+		t.Fatalf("enforceCrashRetention failed: %v", err)
+	}
+
+	if err := datastore.Get(c, reproKey, new(Crash)); err != nil {
+		t.Fatalf("crash with reproducer should survive pruning, got err=%v", err)
+	}
+}
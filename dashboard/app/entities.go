@@ -21,6 +21,9 @@ const (
 	maxTextLen   = 200
 	MaxStringLen = 1024
 
+	// maxCrashes is the fallback crash retention cap used for namespaces
+	// that don't configure their own CrashRetentionPolicy, see
+	// namespaceCrashRetention.
 	maxCrashes = 20
 )
 
@@ -36,14 +39,14 @@ type Build struct {
 	KernelRepo      string
 	KernelBranch    string
 	KernelCommit    string
-	KernelConfig    int64 // reference to KernelConfig text entity
+	KernelConfig    string // key of the KernelConfig text entity
 }
 
 type Bug struct {
 	Namespace  string
 	Seq        int64 // sequences of the bug with the same title
 	Title      string
-	Status     int
+	Status     int // see addBugHistory for which bug changes are recorded
 	DupOf      string
 	NumCrashes int64
 	NumRepro   int64
@@ -55,6 +58,14 @@ type Bug struct {
 	Reporting  []BugReporting
 	Commits    []string
 	PatchedOn  []string
+
+	// Signature is a MinHash signature over the normalized crash report
+	// (see computeSignature), used to find similar existing bugs to
+	// suggest as dups. SuggestedDupOf, if set, is the hash of the most
+	// similar bug found at creation time; it's only a suggestion and is
+	// never acted on without a human confirming it via the dashboard UI.
+	Signature      []uint64 `datastore:",noindex"`
+	SuggestedDupOf string
 }
 
 type BugReporting struct {
@@ -73,11 +84,11 @@ type Crash struct {
 	BuildID     string
 	Time        time.Time
 	Maintainers []string `datastore:",noindex"`
-	Log         int64    // reference to CrashLog text entity
-	Report      int64    // reference to CrashReport text entity
+	Log         string   // key of the CrashLog text entity
+	Report      string   // key of the CrashReport text entity
 	ReproOpts   []byte   `datastore:",noindex"`
-	ReproSyz    int64    // reference to ReproSyz text entity
-	ReproC      int64    // reference to ReproC text entity
+	ReproSyz    string   // key of the ReproSyz text entity
+	ReproC      string   // key of the ReproC text entity
 	ReportLen   int
 }
 
@@ -94,12 +105,62 @@ type ReportingStateEntry struct {
 	Date int
 }
 
-// Text holds text blobs (crash logs, reports, reproducers, etc).
+// Text holds text blobs (crash logs, reports, reproducers, etc), deduped
+// by content within a namespace: identical reproducers and configs are
+// extremely common across crashes and are stored only once. Entities are
+// keyed by Key (see textKey) rather than an auto-generated id, and RefCount
+// tracks how many Build/Crash fields still point at this blob so it can be
+// dropped once nothing references it anymore.
 type Text struct {
 	Namespace string
+	Key       string // SHA-256 of the uncompressed Text, see textHash
 	Text      []byte `datastore:",noindex"` // gzip-compressed text
+	RefCount  int64
+}
+
+// BugHistory records a single change to a bug: a status transition, a dup
+// change, a reproducer-level upgrade, or a reporting-stage advancement. It
+// exists so that dup loops (see canonicalBug) and silent status flips stay
+// debuggable long after the fact.
+type BugHistory struct {
+	Namespace string
+	BugHash   string
+	Time      time.Time
+	Actor     string // external system name (e.g. "syzbot") or user email
+	Action    string // one of the bugHistory* action constants below
+	OldValue  string
+	NewValue  string
+	Reason    string `datastore:",noindex"`
+}
+
+// BugSignatureBand indexes one LSH band of a bug's Signature, so that
+// candidate similar bugs can be found without scanning every Bug in a
+// namespace. See computeSignature and lshBandHashes for how bands relate
+// to the full signature.
+type BugSignatureBand struct {
+	Namespace string
+	Band      int // band index, 0..signatureBands-1
+	Hash      string
+	BugHash   string
+}
+
+// NamespaceSimilarityConfig stores an admin-tunable override for the
+// Jaccard similarity threshold used to suggest dups in a namespace,
+// overriding defaultSimilarityThreshold.
+type NamespaceSimilarityConfig struct {
+	Namespace string
+	Threshold float64 // in (0, 1]; zero/absent means "use the default"
 }
 
+const (
+	bugHistoryStatus        = "status"
+	bugHistoryDup           = "dup"
+	bugHistoryReproLevel    = "repro"
+	bugHistoryReportingSent = "reporting-sent"
+	bugHistoryReportingDone = "reporting-done"
+	bugHistorySuggestedDup  = "suggested-dup"
+)
+
 const (
 	BugStatusOpen = iota
 )
@@ -184,9 +245,36 @@ func bugReportingHash(bugHash, reporting string) string {
 	return hash.String([]byte(fmt.Sprintf("%v-%v", bugHash, reporting)))
 }
 
-func textLink(tag string, id int64) string {
-	if id == 0 {
+func bugHistoryKey(c context.Context, bugHash string, t time.Time) *datastore.Key {
+	h := hash.String([]byte(fmt.Sprintf("%v-%v", bugHash, t.UnixNano())))
+	return datastore.NewKey(c, "BugHistory", h, 0, nil)
+}
+
+// addBugHistory appends an audit log entry for bugHash; actor is either an
+// external system name (e.g. "syzbot") or the email of the user who made
+// the change. It is called only where SuggestedDupOf changes (onBugCreated,
+// apiRecluster); changes to Bug.Status, Bug.DupOf, Bug.ReproLevel and
+// BugReporting.Reported/Closed are not recorded by any caller.
+func addBugHistory(c context.Context, ns, bugHash, actor, action, oldValue, newValue, reason string) error {
+	hist := &BugHistory{
+		Namespace: ns,
+		BugHash:   bugHash,
+		Time:      time.Now(),
+		Actor:     actor,
+		Action:    action,
+		OldValue:  oldValue,
+		NewValue:  newValue,
+		Reason:    reason,
+	}
+	if _, err := datastore.Put(c, bugHistoryKey(c, bugHash, hist.Time), hist); err != nil {
+		return fmt.Errorf("failed to save bug history for %v: %v", bugHash, err)
+	}
+	return nil
+}
+
+func textLink(tag string, key string) string {
+	if key == "" {
 		return ""
 	}
-	return fmt.Sprintf("/text?tag=%v&id=%v", tag, id)
+	return fmt.Sprintf("/text?tag=%v&key=%v", tag, key)
 }
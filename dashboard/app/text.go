@@ -0,0 +1,137 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func textHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func textKey(c context.Context, ns, key string) *datastore.Key {
+	return datastore.NewKey(c, "Text", ns+"-"+key, 0, nil)
+}
+
+// putText stores data as a namespaced, content-addressed Text entity and
+// returns its key. If identical content was already stored, its RefCount is
+// incremented instead of writing a duplicate blob; the caller must pair
+// every putText with a releaseText once the reference is dropped. putText
+// opens its own transaction, so it must not be called by code that's
+// already inside one (datastore transactions don't nest) — use putTextTx
+// from such callers instead.
+func putText(c context.Context, ns string, data []byte) (string, error) {
+	var key string
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		var err error
+		key, err = putTextTx(c, ns, data)
+		return err
+	}, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to put text %v: %v", ns, err)
+	}
+	return key, nil
+}
+
+// putTextTx is putText's transactional body, for callers that already hold
+// a transaction on c.
+func putTextTx(c context.Context, ns string, data []byte) (string, error) {
+	key := textHash(data)
+	dbKey := textKey(c, ns, key)
+	text := new(Text)
+	err := datastore.Get(c, dbKey, text)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return "", err
+	}
+	if err == datastore.ErrNoSuchEntity {
+		compressed, err := gzipData(data)
+		if err != nil {
+			return "", err
+		}
+		text.Namespace = ns
+		text.Key = key
+		text.Text = compressed
+	}
+	text.RefCount++
+	if _, err := datastore.Put(c, dbKey, text); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// releaseText drops one reference to the content-addressed Text entity
+// identified by key, deleting it once no references remain. It is a no-op
+// for an empty key, so it's safe to call on fields that were never set.
+// releaseText opens its own transaction, so it must not be called by code
+// that's already inside one — use releaseTextTx from such callers instead.
+func releaseText(c context.Context, ns, key string) error {
+	if key == "" {
+		return nil
+	}
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		return releaseTextTx(c, ns, key)
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to release text %v/%v: %v", ns, key, err)
+	}
+	return nil
+}
+
+// releaseTextTx is releaseText's transactional body, for callers that
+// already hold a transaction on c (e.g. enforceCrashRetention, which runs
+// inside saveCrash's/cleanupCrashRetention's transaction).
+func releaseTextTx(c context.Context, ns, key string) error {
+	if key == "" {
+		return nil
+	}
+	dbKey := textKey(c, ns, key)
+	text := new(Text)
+	if err := datastore.Get(c, dbKey, text); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+	text.RefCount--
+	if text.RefCount <= 0 {
+		return datastore.Delete(c, dbKey)
+	}
+	_, err := datastore.Put(c, dbKey, text)
+	return err
+}
+
+func gzipData(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to gzip text: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to gzip text: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipData(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to gunzip text: %v", err)
+	}
+	defer zr.Close()
+	res, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to gunzip text: %v", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// legacyText is the pre-dedup shape of the Text entity (auto-generated
+// int64 id, one row per reference, no RefCount), kept only so that
+// migrateTextDedup can decode the rows it's replacing.
+type legacyText struct {
+	Namespace string
+	Text      []byte `datastore:",noindex"`
+}
+
+// legacyCrash mirrors the pre-migration Crash shape, whose Log/Report/
+// ReproSyz/ReproC were legacy Text ids rather than content keys. It exists
+// because Crash now declares those fields as string, so decoding an
+// unmigrated row straight into Crash would be a property type mismatch.
+type legacyCrash struct {
+	Manager     string
+	BuildID     string
+	Time        time.Time
+	Maintainers []string `datastore:",noindex"`
+	Log         int64
+	Report      int64
+	ReproOpts   []byte `datastore:",noindex"`
+	ReproSyz    int64
+	ReproC      int64
+	ReportLen   int
+}
+
+// legacyBuild mirrors the pre-migration Build shape, whose KernelConfig was
+// a legacy Text id rather than a content key; see legacyCrash.
+type legacyBuild struct {
+	Namespace       string
+	Manager         string
+	ID              string
+	OS              string
+	Arch            string
+	VMArch          string
+	SyzkallerCommit string
+	CompilerID      string
+	KernelRepo      string
+	KernelBranch    string
+	KernelCommit    string
+	KernelConfig    int64
+}
+
+// migrateTextDedup is a one-off admin-triggered job: it walks every legacy
+// (int64-keyed, un-deduped) Text row referenced by a Crash or Build,
+// rewrites the referencing field to the new content-addressed key via
+// putText, and deletes the legacy row. Content that's identical across
+// many crashes collapses onto a single Text entity with RefCount>1.
+func migrateTextDedup(c context.Context) error {
+	crashKeys, err := datastore.NewQuery("Crash").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return fmt.Errorf("failed to query crashes: %v", err)
+	}
+	for _, crashKey := range crashKeys {
+		if err := migrateCrashText(c, crashKey); err != nil {
+			return err
+		}
+	}
+	buildKeys, err := datastore.NewQuery("Build").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return fmt.Errorf("failed to query builds: %v", err)
+	}
+	for _, buildKey := range buildKeys {
+		if err := migrateBuildText(c, buildKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateCrashText rewrites one Crash's legacy int64 text references to
+// content-addressed keys. It intentionally does not wrap the whole
+// read-migrate-write sequence in a single transaction, since migrateTextRef
+// opens its own transaction per text via putText and datastore transactions
+// don't nest; re-running it after a partial failure is safe because it
+// checks whether a row was already migrated before decoding it as legacy.
+func migrateCrashText(c context.Context, crashKey *datastore.Key) error {
+	migrated, err := crashAlreadyMigrated(c, crashKey)
+	if err != nil {
+		return fmt.Errorf("failed to get crash %v: %v", crashKey, err)
+	}
+	if migrated {
+		return nil
+	}
+	legacy := new(legacyCrash)
+	if err := datastore.Get(c, crashKey, legacy); err != nil {
+		return fmt.Errorf("failed to get legacy crash %v: %v", crashKey, err)
+	}
+	ns, err := crashNamespace(c, crashKey)
+	if err != nil {
+		return err
+	}
+	logKey, err := migrateTextRef(c, ns, legacy.Log)
+	if err != nil {
+		return err
+	}
+	reportKey, err := migrateTextRef(c, ns, legacy.Report)
+	if err != nil {
+		return err
+	}
+	reproSyzKey, err := migrateTextRef(c, ns, legacy.ReproSyz)
+	if err != nil {
+		return err
+	}
+	reproCKey, err := migrateTextRef(c, ns, legacy.ReproC)
+	if err != nil {
+		return err
+	}
+	crash := &Crash{
+		Manager:     legacy.Manager,
+		BuildID:     legacy.BuildID,
+		Time:        legacy.Time,
+		Maintainers: legacy.Maintainers,
+		Log:         logKey,
+		Report:      reportKey,
+		ReproOpts:   legacy.ReproOpts,
+		ReproSyz:    reproSyzKey,
+		ReproC:      reproCKey,
+		ReportLen:   legacy.ReportLen,
+	}
+	if _, err := datastore.Put(c, crashKey, crash); err != nil {
+		return fmt.Errorf("failed to save migrated crash %v: %v", crashKey, err)
+	}
+	return nil
+}
+
+// migrateBuildText rewrites one Build's legacy int64 KernelConfig
+// reference to a content-addressed key; see migrateCrashText for why this
+// isn't wrapped in its own transaction or relies on a type-mismatch error.
+func migrateBuildText(c context.Context, buildKey *datastore.Key) error {
+	migrated, err := buildAlreadyMigrated(c, buildKey)
+	if err != nil {
+		return fmt.Errorf("failed to get build %v: %v", buildKey, err)
+	}
+	if migrated {
+		return nil
+	}
+	legacy := new(legacyBuild)
+	if err := datastore.Get(c, buildKey, legacy); err != nil {
+		return fmt.Errorf("failed to get legacy build %v: %v", buildKey, err)
+	}
+	key, err := migrateTextRef(c, legacy.Namespace, legacy.KernelConfig)
+	if err != nil {
+		return err
+	}
+	build := &Build{
+		Namespace:       legacy.Namespace,
+		Manager:         legacy.Manager,
+		ID:              legacy.ID,
+		OS:              legacy.OS,
+		Arch:            legacy.Arch,
+		VMArch:          legacy.VMArch,
+		SyzkallerCommit: legacy.SyzkallerCommit,
+		CompilerID:      legacy.CompilerID,
+		KernelRepo:      legacy.KernelRepo,
+		KernelBranch:    legacy.KernelBranch,
+		KernelCommit:    legacy.KernelCommit,
+		KernelConfig:    key,
+	}
+	if _, err := datastore.Put(c, buildKey, build); err != nil {
+		return fmt.Errorf("failed to save migrated build %v: %v", buildKey, err)
+	}
+	return nil
+}
+
+// crashNamespace resolves the namespace a Crash's text should be migrated
+// into. A Crash's parent key is its Bug, keyed by bugKeyHash's opaque hash
+// rather than the plain namespace string, so crashKey.Parent().StringID()
+// is the hash, not the namespace; the real namespace has to come from the
+// parent Bug entity's Namespace field instead.
+func crashNamespace(c context.Context, crashKey *datastore.Key) (string, error) {
+	bug := new(Bug)
+	if err := datastore.Get(c, crashKey.Parent(), bug); err != nil {
+		return "", fmt.Errorf("failed to get bug %v for crash %v: %v", crashKey.Parent(), crashKey, err)
+	}
+	return bug.Namespace, nil
+}
+
+// crashAlreadyMigrated reports whether crashKey's Log property is already a
+// content-addressed string key rather than a legacy int64 Text id, by
+// inspecting the raw stored property instead of decoding into either typed
+// struct (which would fail with a property type mismatch on whichever
+// shape doesn't match).
+func crashAlreadyMigrated(c context.Context, crashKey *datastore.Key) (bool, error) {
+	var props datastore.PropertyList
+	if err := datastore.Get(c, crashKey, &props); err != nil {
+		return false, err
+	}
+	return propAlreadyMigrated(props, "Log"), nil
+}
+
+// buildAlreadyMigrated is crashAlreadyMigrated's counterpart for Build's
+// KernelConfig field.
+func buildAlreadyMigrated(c context.Context, buildKey *datastore.Key) (bool, error) {
+	var props datastore.PropertyList
+	if err := datastore.Get(c, buildKey, &props); err != nil {
+		return false, err
+	}
+	return propAlreadyMigrated(props, "KernelConfig"), nil
+}
+
+// propAlreadyMigrated reports whether the named property, if present, is
+// already a string (the post-migration shape). A missing property is
+// treated as already migrated, since every pre-migration row always had
+// the corresponding int64 field set by the datastore mapping.
+func propAlreadyMigrated(props datastore.PropertyList, name string) bool {
+	for _, p := range props {
+		if p.Name != name {
+			continue
+		}
+		_, isString := p.Value.(string)
+		return isString
+	}
+	return true
+}
+
+// migrateTextRef reads the legacy int64-keyed Text row id, if any, and
+// returns the content-addressed key that replaces it, dropping the legacy
+// row once its content has been folded into the deduped store.
+func migrateTextRef(c context.Context, ns string, id int64) (string, error) {
+	if id == 0 {
+		return "", nil
+	}
+	legacyKey := datastore.NewKey(c, "Text", "", id, nil)
+	legacy := new(legacyText)
+	if err := datastore.Get(c, legacyKey, legacy); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get legacy text %v: %v", id, err)
+	}
+	data, err := gunzipData(legacy.Text)
+	if err != nil {
+		return "", err
+	}
+	key, err := putText(c, ns, data)
+	if err != nil {
+		return "", err
+	}
+	if err := datastore.Delete(c, legacyKey); err != nil {
+		return "", fmt.Errorf("failed to delete legacy text %v: %v", id, err)
+	}
+	return key, nil
+}
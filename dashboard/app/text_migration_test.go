@@ -0,0 +1,69 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// TestMigrateCrashTextUsesBugNamespace guards against resolving the
+// namespace from crashKey.Parent().StringID(), which is the parent Bug's
+// opaque bugKeyHash, not its namespace.
+func TestMigrateCrashTextUsesBugNamespace(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	const ns = "real-namespace"
+	bug := &Bug{Namespace: ns, Title: "some bug"}
+	bugKey, err := datastore.Put(c, datastore.NewKey(c, "Bug", "some-opaque-hash", 0, nil), bug)
+	if err != nil {
+		t.Fatalf("failed to put bug: %v", err)
+	}
+
+	data := []byte("legacy crash log")
+	legacyTextKey := datastore.NewIncompleteKey(c, "Text", nil)
+	legacyTextKey, err = datastore.Put(c, legacyTextKey, &legacyText{Namespace: ns, Text: mustGzip(t, data)})
+	if err != nil {
+		t.Fatalf("failed to put legacy text: %v", err)
+	}
+
+	crashKey := datastore.NewIncompleteKey(c, "Crash", bugKey)
+	crashKey, err = datastore.Put(c, crashKey, &legacyCrash{
+		Manager: "manager1",
+		BuildID: "build1",
+		Log:     legacyTextKey.IntID(),
+	})
+	if err != nil {
+		t.Fatalf("failed to put legacy crash: %v", err)
+	}
+
+	if err := migrateCrashText(c, crashKey); err != nil {
+		t.Fatalf("migrateCrashText failed: %v", err)
+	}
+
+	crash := new(Crash)
+	if err := datastore.Get(c, crashKey, crash); err != nil {
+		t.Fatalf("failed to get migrated crash: %v", err)
+	}
+	if crash.Log == "" {
+		t.Fatalf("migrated crash has no Log key")
+	}
+
+	// The migrated text must be retrievable under the bug's real
+	// namespace, not under its opaque key hash.
+	text := new(Text)
+	if err := datastore.Get(c, textKey(c, ns, crash.Log), text); err != nil {
+		t.Fatalf("migrated text not found under bug namespace %v: %v", ns, err)
+	}
+}
+
+func mustGzip(t *testing.T, data []byte) []byte {
+	compressed, err := gzipData(data)
+	if err != nil {
+		t.Fatalf("failed to gzip test data: %v", err)
+	}
+	return compressed
+}
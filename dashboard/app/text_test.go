@@ -0,0 +1,89 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestPutTextDedupsAndRefcounts(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	const ns = "test-ns"
+	data := []byte("crash report body")
+
+	key1, err := putText(c, ns, data)
+	if err != nil {
+		t.Fatalf("putText failed: %v", err)
+	}
+	key2, err := putText(c, ns, data)
+	if err != nil {
+		t.Fatalf("second putText failed: %v", err)
+	}
+	if key1 != key2 {
+		t.Fatalf("identical content got different keys: %v != %v", key1, key2)
+	}
+
+	text := new(Text)
+	if err := datastore.Get(c, textKey(c, ns, key1), text); err != nil {
+		t.Fatalf("failed to get text: %v", err)
+	}
+	if text.RefCount != 2 {
+		t.Fatalf("want RefCount=2 after two puts, got %v", text.RefCount)
+	}
+
+	other, err := putText(c, ns, []byte("a different report"))
+	if err != nil {
+		t.Fatalf("putText for different content failed: %v", err)
+	}
+	if other == key1 {
+		t.Fatalf("different content got the same key")
+	}
+}
+
+func TestReleaseTextDeletesAtZeroRefcount(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	const ns = "test-ns"
+	data := []byte("crash report body")
+
+	key, err := putText(c, ns, data)
+	if err != nil {
+		t.Fatalf("putText failed: %v", err)
+	}
+	if _, err := putText(c, ns, data); err != nil {
+		t.Fatalf("second putText failed: %v", err)
+	}
+
+	if err := releaseText(c, ns, key); err != nil {
+		t.Fatalf("releaseText failed: %v", err)
+	}
+	text := new(Text)
+	if err := datastore.Get(c, textKey(c, ns, key), text); err != nil {
+		t.Fatalf("text disappeared after one of two releases: %v", err)
+	}
+	if text.RefCount != 1 {
+		t.Fatalf("want RefCount=1, got %v", text.RefCount)
+	}
+
+	if err := releaseText(c, ns, key); err != nil {
+		t.Fatalf("second releaseText failed: %v", err)
+	}
+	if err := datastore.Get(c, textKey(c, ns, key), text); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("want entity deleted once RefCount reaches 0, got err=%v", err)
+	}
+}
+
+func TestReleaseTextNoopOnEmptyKey(t *testing.T) {
+	c, done := newTestContext(t)
+	defer done()
+
+	if err := releaseText(c, "test-ns", ""); err != nil {
+		t.Fatalf("releaseText on empty key should be a no-op, got: %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dashapi
+
+import "time"
+
+// BugHistoryReq queries the change history of a single bug, identified by
+// its hash (as used throughout the dashboard).
+type BugHistoryReq struct {
+	BugHash string
+	Cursor  string // opaque pagination cursor returned as BugHistoryResp.Cursor
+}
+
+// BugHistoryResp is a page of BugHistoryEntry, newest first.
+type BugHistoryResp struct {
+	Entries []BugHistoryEntry
+	Cursor  string // pass to the next BugHistoryReq to fetch the following page; empty if done
+}
+
+type BugHistoryEntry struct {
+	Time     time.Time
+	Actor    string
+	Action   string
+	OldValue string
+	NewValue string
+	Reason   string
+}
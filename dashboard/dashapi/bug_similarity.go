@@ -0,0 +1,24 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dashapi
+
+// SimilarityConfigReq sets the admin-tunable dup-suggestion similarity
+// threshold for a namespace.
+type SimilarityConfigReq struct {
+	Namespace string
+	Threshold float64 // Jaccard similarity in (0, 1]
+}
+
+type SimilarityConfigResp struct {
+}
+
+// ReclusterReq re-runs dup suggestion for every signatured bug in a
+// namespace against its current similarity threshold.
+type ReclusterReq struct {
+	Namespace string
+}
+
+type ReclusterResp struct {
+	Updated int // number of bugs whose SuggestedDupOf changed
+}